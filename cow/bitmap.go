@@ -0,0 +1,117 @@
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: MIT
+
+package cow
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// bitmap tracks which blocks have been written to an overlay, one bit per
+// block, growing on demand as higher block numbers are touched.
+type bitmap struct {
+	mu   sync.Mutex
+	bits []byte
+}
+
+func newBitmap() *bitmap {
+	return &bitmap{}
+}
+
+// bitPos splits block into the byte index and the mask of its bit within
+// that byte, shared by every method that reads or writes a single bit.
+func bitPos(block int64) (idx int64, mask byte) {
+	return block / 8, byte(1) << uint(block%8)
+}
+
+// markDirty sets the bit for block and reports whether it was already set.
+func (b *bitmap) markDirty(block int64) (alreadyDirty bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, mask := bitPos(block)
+	if idx >= int64(len(b.bits)) {
+		grown := make([]byte, idx+1)
+		copy(grown, b.bits)
+		b.bits = grown
+	}
+
+	alreadyDirty = b.bits[idx]&mask != 0
+	b.bits[idx] |= mask
+	return alreadyDirty
+}
+
+// clearDirty unsets the bit for block, e.g. once Commit has folded its data
+// down into base and reads for it should fall through again.
+func (b *bitmap) clearDirty(block int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, mask := bitPos(block)
+	if idx >= int64(len(b.bits)) {
+		return
+	}
+	b.bits[idx] &^= mask
+}
+
+func (b *bitmap) isDirty(block int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, mask := bitPos(block)
+	if idx >= int64(len(b.bits)) {
+		return false
+	}
+	return b.bits[idx]&mask != 0
+}
+
+// blocks returns every block number currently marked dirty, in ascending
+// order.
+func (b *bitmap) blocks() []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []int64
+	for i, v := range b.bits {
+		if v == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if v&(1<<uint(bit)) != 0 {
+				out = append(out, int64(i)*8+int64(bit))
+			}
+		}
+	}
+	return out
+}
+
+// loadJournal replays a journal previously written by appendJournalEntry,
+// marking every recorded block dirty.
+func (b *bitmap) loadJournal(f *os.File) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, stat.Size())
+	if _, err := io.ReadFull(f, data); err != nil && err != io.EOF {
+		return err
+	}
+
+	for i := 0; i+8 <= len(data); i += 8 {
+		b.markDirty(int64(binary.BigEndian.Uint64(data[i : i+8])))
+	}
+	return nil
+}
+
+// appendJournalEntry records that block was dirtied, so the bitmap can be
+// rebuilt by loadJournal after a restart.
+func appendJournalEntry(f *os.File, block int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(block))
+	_, err := f.Write(buf[:])
+	return err
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: MIT
+
+// Package cow provides copy-on-write layering over nbd.Device, so a
+// writable NBD export can be backed by a read-only image (an ISO, a
+// qcow-like base) without changing nbd.NBD itself.
+package cow
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	nbd "github.com/derlaft/go-nbd"
+)
+
+// DefaultBlockSize is the granularity at which Layer tracks which blocks
+// have been written to the overlay, used when the caller doesn't pick one
+// explicitly.
+const DefaultBlockSize = 4096
+
+// Layer implements nbd.Device by directing reads to overlay for any block
+// previously written and to base otherwise, and directing all writes to
+// overlay. base is never modified except by Commit.
+type Layer struct {
+	mu        sync.RWMutex
+	base      nbd.Device
+	overlay   nbd.Device
+	blockSize int64
+	dirty     *bitmap
+	journal   *os.File
+}
+
+// New composes base and overlay into a single nbd.Device using
+// DefaultBlockSize.
+func New(base, overlay nbd.Device) *Layer {
+	return NewSize(base, overlay, DefaultBlockSize)
+}
+
+// NewSize is New with an explicit block size.
+func NewSize(base, overlay nbd.Device, blockSize int64) *Layer {
+	return &Layer{base: base, overlay: overlay, blockSize: blockSize, dirty: newBitmap()}
+}
+
+// Open is NewSize plus an on-disk journal: if journalPath already exists,
+// its recorded dirty blocks are loaded before the layer is used, so the
+// overlay/base split survives a restart; every newly dirtied block is then
+// appended to it as writes happen.
+func Open(base, overlay nbd.Device, blockSize int64, journalPath string) (*Layer, error) {
+	l := NewSize(base, overlay, blockSize)
+
+	f, err := os.OpenFile(journalPath, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.dirty.loadJournal(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.journal = f
+
+	return l, nil
+}
+
+// ReadAt implements nbd.Device.
+func (l *Layer) ReadAt(b []byte, off int64) (int, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	read := 0
+	for read < len(b) {
+		block := (off + int64(read)) / l.blockSize
+		blockOff := (off + int64(read)) % l.blockSize
+
+		chunk := b[read:]
+		if max := int(l.blockSize - blockOff); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		src := l.base
+		if l.dirty.isDirty(block) {
+			src = l.overlay
+		}
+
+		n, err := src.ReadAt(chunk, off+int64(read))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// WriteAt implements nbd.Device: writes always land on overlay, and every
+// block they touch is marked (and journaled, if a journal is open) dirty.
+func (l *Layer) WriteAt(b []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, err := l.overlay.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+
+	first := off / l.blockSize
+	last := (off + int64(n) - 1) / l.blockSize
+	for block := first; block <= last; block++ {
+		if l.dirty.markDirty(block) {
+			continue // already dirty, nothing new to journal
+		}
+		if l.journal != nil {
+			if err := appendJournalEntry(l.journal, block); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Sync implements nbd.Device.
+func (l *Layer) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.overlay.Sync(); err != nil {
+		return err
+	}
+	if l.journal != nil {
+		return l.journal.Sync()
+	}
+	return nil
+}
+
+// Snapshot freezes the current overlay and its dirty bitmap into a backing
+// layer and starts a fresh, empty in-memory overlay on top of it, so l's own
+// writes no longer reach the frozen overlay. The returned Device is that
+// frozen layer; any journal is handed off to it too, since it now describes
+// that frozen state rather than the new overlay. The returned Device is not
+// write-protected: its WriteAt still writes into the frozen overlay. A later
+// Commit on l writes through it to the real base and clears its dirty bits
+// for the committed blocks, so it then reads the committed data there.
+func (l *Layer) Snapshot() (nbd.Device, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	frozen := &Layer{base: l.base, overlay: l.overlay, blockSize: l.blockSize, dirty: l.dirty, journal: l.journal}
+
+	l.base = frozen
+	l.overlay = &memOverlay{}
+	l.dirty = newBitmap()
+	l.journal = nil
+
+	return frozen, nil
+}
+
+// rawBase is implemented by a Device that needs writes folded straight
+// through to the durable storage underneath it rather than routed through
+// its own copy-on-write path. Layer implements it so that Commit on a layer
+// stacked over a Snapshot's frozen Layer reaches the genuine base instead of
+// quietly mutating the "frozen" layer's own overlay.
+type rawBase interface {
+	commitAt(b []byte, off int64) (int, error)
+}
+
+// commitAt writes b directly into l.base, bypassing l's own overlay
+// (recursing through commitAt again if l.base is itself a Layer, so a chain
+// of snapshots always bottoms out at the real base device), then clears l's
+// own dirty bits for the range just written. That last part matters: l may
+// still be marked dirty there from before it was frozen by Snapshot, and
+// leaving that mark in place would make reads keep returning l's stale
+// overlay data instead of falling through to the value Commit just wrote
+// below it. It exists only for Commit to call through when base happens to
+// be a frozen Layer; ordinary reads and writes keep going through
+// ReadAt/WriteAt as usual.
+func (l *Layer) commitAt(b []byte, off int64) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int
+	var err error
+	if rb, ok := l.base.(rawBase); ok {
+		n, err = rb.commitAt(b, off)
+	} else {
+		n, err = l.base.WriteAt(b, off)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	first := off / l.blockSize
+	last := (off + int64(n) - 1) / l.blockSize
+	for block := first; block <= last; block++ {
+		l.dirty.clearDirty(block)
+	}
+
+	return n, nil
+}
+
+// Commit writes every dirty block from the overlay back into base and
+// clears the dirty bitmap (and journal, if any), so base becomes
+// authoritative again and the overlay can be treated as empty. If base is
+// itself a Layer (this layer sits on top of a Snapshot), the writes are
+// folded through its commitAt rather than its WriteAt, so they land on the
+// real base device instead of mutating the frozen snapshot's overlay.
+func (l *Layer) Commit() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	writeBase := l.base.WriteAt
+	if rb, ok := l.base.(rawBase); ok {
+		writeBase = rb.commitAt
+	}
+
+	buf := make([]byte, l.blockSize)
+	for _, block := range l.dirty.blocks() {
+		off := block * l.blockSize
+		n, err := l.overlay.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := writeBase(buf[:n], off); err != nil {
+			return err
+		}
+	}
+
+	l.dirty = newBitmap()
+	if l.journal != nil {
+		if err := l.journal.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := l.journal.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memOverlay is a simple growable in-memory nbd.Device, used as the fresh
+// overlay Snapshot starts on top of the frozen layer.
+type memOverlay struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (m *memOverlay) ReadAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off >= int64(len(m.data)) {
+		return 0, nil
+	}
+	return copy(b, m.data[off:]), nil
+}
+
+func (m *memOverlay) WriteAt(b []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	return copy(m.data[off:], b), nil
+}
+
+func (m *memOverlay) Sync() error { return nil }
@@ -0,0 +1,102 @@
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: MIT
+
+package cow
+
+import "testing"
+
+// TestCommitAfterSnapshotReachesRealBase checks that a write made after
+// Snapshot, once Committed, lands on the genuine base device rather than
+// mutating the frozen snapshot's own overlay (Commit must fold through a
+// frozen Layer via commitAt, not WriteAt).
+func TestCommitAfterSnapshotReachesRealBase(t *testing.T) {
+	base := &memOverlay{}
+	l := NewSize(base, &memOverlay{}, 512)
+
+	block0 := make([]byte, 512)
+	for i := range block0 {
+		block0[i] = 0xAA
+	}
+	if _, err := l.WriteAt(block0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	block1 := make([]byte, 512)
+	for i := range block1 {
+		block1[i] = 0xBB
+	}
+	if _, err := l.WriteAt(block1, 512); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 512)
+	if _, err := base.ReadAt(got, 512); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		if b != 0xBB {
+			t.Fatalf("base block1 byte %d = %#x, want 0xbb (post-snapshot commit never reached the real base)", i, b)
+		}
+	}
+
+	// And the pre-snapshot block stays in the snapshot's frozen overlay:
+	// the commit must not push it down into the real base.
+	frozenByte := make([]byte, 1)
+	if _, err := base.ReadAt(frozenByte, 0); err != nil {
+		t.Fatal(err)
+	}
+	if frozenByte[0] != 0 {
+		t.Fatalf("pre-snapshot block0 leaked into the real base: got %#x, want 0x00", frozenByte[0])
+	}
+}
+
+// TestCommitOverwritesBlockDirtiedBeforeSnapshot checks the case where the
+// same block is written both before and after Snapshot: once Committed, the
+// layer must read back the newer, post-snapshot value rather than the
+// frozen snapshot's now-stale one.
+func TestCommitOverwritesBlockDirtiedBeforeSnapshot(t *testing.T) {
+	base := &memOverlay{}
+	l := NewSize(base, &memOverlay{}, 512)
+
+	pre := make([]byte, 512)
+	for i := range pre {
+		pre[i] = 0x11
+	}
+	if _, err := l.WriteAt(pre, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	post := make([]byte, 512)
+	for i := range post {
+		post[i] = 0x22
+	}
+	if _, err := l.WriteAt(post, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 512)
+	if _, err := l.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range got {
+		if b != 0x22 {
+			t.Fatalf("byte %d = %#x, want 0x22 (committed write masked by the frozen snapshot's stale overlay)", i, b)
+		}
+	}
+}
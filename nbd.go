@@ -5,11 +5,12 @@
 package nbd
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 )
 
 // @TODO: include that files directly?
@@ -29,23 +30,34 @@ const (
 	NBD_SET_TIMEOUT     = 43785
 	NBD_SET_FLAGS       = 43786
 	// enum
-	NBD_CMD_READ  = 0
-	NBD_CMD_WRITE = 1
-	NBD_CMD_DISC  = 2
-	NBD_CMD_FLUSH = 3
-	NBD_CMD_TRIM  = 4
+	NBD_CMD_READ         = 0
+	NBD_CMD_WRITE        = 1
+	NBD_CMD_DISC         = 2
+	NBD_CMD_FLUSH        = 3
+	NBD_CMD_TRIM         = 4
+	NBD_CMD_WRITE_ZEROES = 6
+	// command flags (top 16 bits of the request's type field)
+	NBD_CMD_FLAG_FUA     = (1 << 0) // Force Unit Access: flush before replying
+	NBD_CMD_FLAG_NO_HOLE = (1 << 1) // don't punch a hole, write actual zeroes
 	// values for flags field
-	NBD_FLAG_HAS_FLAGS  = (1 << 0) // nbd-server supports flags
-	NBD_FLAG_READ_ONLY  = (1 << 1) // device is read-only
-	NBD_FLAG_SEND_FLUSH = (1 << 2) // can flush writeback cache
-	NBD_FLAG_SEND_FUA   = (1 << 3) // Send FUA (Force Unit Access)
-	NBD_FLAG_ROTATIONAL = (1 << 4) // Use elevator algorithm - rotational media
-	NBD_FLAG_SEND_TRIM  = (1 << 5) // Send TRIM (discard)
+	NBD_FLAG_HAS_FLAGS         = (1 << 0) // nbd-server supports flags
+	NBD_FLAG_READ_ONLY         = (1 << 1) // device is read-only
+	NBD_FLAG_SEND_FLUSH        = (1 << 2) // can flush writeback cache
+	NBD_FLAG_SEND_FUA          = (1 << 3) // Send FUA (Force Unit Access)
+	NBD_FLAG_ROTATIONAL        = (1 << 4) // Use elevator algorithm - rotational media
+	NBD_FLAG_SEND_TRIM         = (1 << 5) // Send TRIM (discard)
+	NBD_FLAG_SEND_WRITE_ZEROES = (1 << 6) // Send WRITE_ZEROES
 
 	// These are sent over the network in the request/reply magic fields
 	NBD_REQUEST_MAGIC = 0x25609513
 	NBD_REPLY_MAGIC   = 0x67446698
 	// Do *not* use magics: 0x12560953 0x96744668.
+
+	// Errno values sent back to the client in a reply's error field.
+	NBD_EPERM  = 1
+	NBD_EIO    = 5
+	NBD_EINVAL = 22
+	NBD_ENOSPC = 28
 )
 
 // ioctl() helper function
@@ -66,9 +78,24 @@ type Device interface {
 	Sync() error
 }
 
+// Trimmer is an optional Device extension. Devices that can discard a range
+// efficiently implement it so NBD_CMD_TRIM is forwarded to them instead of
+// being rejected.
+type Trimmer interface {
+	TrimAt(off int64, len uint32) error
+}
+
+// Zeroer is an optional Device extension. Devices that can zero a range
+// efficiently implement it so NBD_CMD_WRITE_ZEROES is forwarded to them
+// instead of falling back to writing a buffer of zeroes.
+type Zeroer interface {
+	ZeroAt(off int64, len uint32, flags uint32) error
+}
+
 type request struct {
 	magic  uint32
-	typus  uint32
+	typus  uint16
+	flags  uint16
 	handle uint64
 	from   uint64
 	len    uint32
@@ -81,14 +108,41 @@ type reply struct {
 }
 
 type NBD struct {
-	device Device
-	size   uint64
-	nbd    *os.File
-	socket int
+	device      Device
+	size        uint64
+	nbd         *os.File
+	socket      int
+	socketFile  *os.File
+	maxInFlight int
+	timeout     time.Duration
+
+	// ErrorHandler, if set, is called with protocol and framing errors
+	// encountered while serving the socket (truncated reads, a client that
+	// violates the wire format) that would previously have crashed the
+	// process via panic.
+	ErrorHandler func(error)
 }
 
 func Create(device Device, size uint64) *NBD {
-	return &NBD{device, size, nil, 0}
+	return &NBD{device: device, size: size, maxInFlight: 1}
+}
+
+// SetMaxInFlight bounds how many requests are dispatched to worker
+// goroutines concurrently, instead of serving the socket one request at a
+// time. It must be called before Connect(); the default is 1, matching the
+// previous strictly serial behaviour.
+func (nbd *NBD) SetMaxInFlight(n int) {
+	if n < 1 {
+		n = 1
+	}
+	nbd.maxInFlight = n
+}
+
+// SetTimeout configures the kernel's NBD_SET_TIMEOUT: how long it waits for
+// a reply before considering the device dead. It must be called before
+// Connect(); zero (the default) leaves the kernel's own default in place.
+func (nbd *NBD) SetTimeout(d time.Duration) {
+	nbd.timeout = d
 }
 
 // return true if connected
@@ -96,11 +150,28 @@ func (nbd *NBD) IsConnected() bool {
 	return nbd.nbd != nil && nbd.socket > 0
 }
 
+// Disconnect closes the kernel-negotiated socket, which in turn makes the
+// NBD_DO_IT ioctl inside a pending Wait() return so it can clean up via
+// NBD_DISCONNECT/NBD_CLEAR_SOCK. It's safe to call this even if the client
+// never sends NBD_CMD_DISC itself.
+func (nbd *NBD) Disconnect() error {
+	if nbd.socketFile == nil {
+		return nil
+	}
+	return nbd.socketFile.Close()
+}
+
 // get the size of the NBD
 func (nbd *NBD) GetSize() uint64 {
 	return nbd.size
 }
 
+// ExportSize reports the export size so NBD can itself be used as a Device
+// behind a Server, in addition to the ioctl-driven /dev/nbdX path.
+func (nbd *NBD) ExportSize() uint64 {
+	return nbd.size
+}
+
 // set the size of the NBD
 func (nbd *NBD) Size(size uint64) (err error) {
 	if err = ioctl(nbd.nbd.Fd(), NBD_SET_BLKSIZE, 4096); err != nil {
@@ -112,8 +183,10 @@ func (nbd *NBD) Size(size uint64) (err error) {
 	return err
 }
 
-// connect the network block device
-func (nbd *NBD) Connect() (string, error) {
+// connect the network block device. ctx may be used to cancel the
+// connection once established: cancelling it calls Disconnect, which makes
+// a pending Wait() return.
+func (nbd *NBD) Connect(ctx context.Context) (string, error) {
 	pair, err := syscall.Socketpair(syscall.SOCK_STREAM, syscall.AF_UNIX, 0)
 
 	if err != nil {
@@ -146,12 +219,25 @@ func (nbd *NBD) Connect() (string, error) {
 		return "", err
 	}
 
-	// set ioctl flags
-	if err = ioctl(nbd.nbd.Fd(), NBD_SET_FLAGS, 1); err != nil {
+	// set ioctl flags, advertising trim/write-zeroes only if the device
+	// actually supports them
+	if err = ioctl(nbd.nbd.Fd(), NBD_SET_FLAGS, uintptr(transmissionFlags(nbd.device))); err != nil {
 		return "", &os.PathError{nbd.nbd.Name(), "ioctl NBD_SET_FLAGS", err}
 	}
 
+	if nbd.timeout > 0 {
+		if err = ioctl(nbd.nbd.Fd(), NBD_SET_TIMEOUT, uintptr(nbd.timeout/time.Second)); err != nil {
+			return "", &os.PathError{nbd.nbd.Name(), "ioctl NBD_SET_TIMEOUT", err}
+		}
+	}
+
 	go nbd.handle()
+
+	go func() {
+		<-ctx.Done()
+		nbd.Disconnect()
+	}()
+
 	return dev, err
 }
 
@@ -180,53 +266,19 @@ func (nbd *NBD) Wait() error {
 	return nil
 }
 
-// handle requests
+// handle requests arriving on the ioctl-negotiated socket; the actual
+// request/reply loop is shared with Server's TCP connections via transmit.
+// Closing the socket on the way out (whether because the client sent
+// NBD_CMD_DISC, Disconnect was called, or the connection broke) is what
+// lets NBD_DO_IT in Wait() return.
 func (nbd *NBD) handle() {
-	buf := make([]byte, 2<<19)
-	var x request
-
-	for {
-		syscall.Read(nbd.socket, buf[0:28])
-
-		x.magic = binary.BigEndian.Uint32(buf)
-		x.typus = binary.BigEndian.Uint32(buf[4:8])
-		x.handle = binary.BigEndian.Uint64(buf[8:16])
-		x.from = binary.BigEndian.Uint64(buf[16:24])
-		x.len = binary.BigEndian.Uint32(buf[24:28])
-
-		switch x.magic {
-		case NBD_REPLY_MAGIC:
-			fallthrough
-		case NBD_REQUEST_MAGIC:
-			switch x.typus {
-			case NBD_CMD_READ:
-				nbd.device.ReadAt(buf[16:16+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(nbd.socket, buf[0:16+x.len])
-			case NBD_CMD_WRITE:
-				n, _ := syscall.Read(nbd.socket, buf[28:28+x.len])
-				for uint32(n) < x.len {
-					m, _ := syscall.Read(nbd.socket, buf[28+n:28+x.len])
-					n += m
-				}
-				nbd.device.WriteAt(buf[28:28+x.len], int64(x.from))
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 0)
-				syscall.Write(nbd.socket, buf[0:16])
-			case NBD_CMD_DISC:
-				panic("Disconnect")
-			case NBD_CMD_FLUSH:
-				nbd.device.Sync()
-			case NBD_CMD_TRIM:
-				binary.BigEndian.PutUint32(buf[0:4], NBD_REPLY_MAGIC)
-				binary.BigEndian.PutUint32(buf[4:8], 1)
-				syscall.Write(nbd.socket, buf[0:16])
-			default:
-				panic("unknown command")
-			}
-		default:
-			panic("Invalid packet")
-		}
+	nbd.socketFile = os.NewFile(uintptr(nbd.socket), "nbd")
+	defer nbd.socketFile.Close()
+	transmit(nbd.socketFile, nbd.device, false, nbd.maxInFlight, nbd.reportError)
+}
+
+func (nbd *NBD) reportError(err error) {
+	if nbd.ErrorHandler != nil {
+		nbd.ErrorHandler(err)
 	}
 }
@@ -0,0 +1,321 @@
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: MIT
+
+package nbd
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// Handshake magics (fixed newstyle negotiation)
+	NBD_MAGIC           = 0x4e42444d41474943 // "NBDMAGIC"
+	NBD_IHAVEOPT        = 0x49484156454f5054 // "IHAVEOPT"
+	NBD_OPT_REPLY_MAGIC = 0x0003e889045565a9
+
+	// Server handshake flags
+	NBD_FLAG_FIXED_NEWSTYLE = (1 << 0) // server supports the fixed newstyle handshake
+	NBD_FLAG_NO_ZEROES      = (1 << 1) // server doesn't need 124 bytes of zero padding
+
+	// Client handshake flags
+	NBD_FLAG_C_FIXED_NEWSTYLE = (1 << 0)
+	NBD_FLAG_C_NO_ZEROES      = (1 << 1)
+
+	// Options the client can send after the handshake
+	NBD_OPT_EXPORT_NAME      = 1
+	NBD_OPT_ABORT            = 2
+	NBD_OPT_LIST             = 3
+	NBD_OPT_STARTTLS         = 5
+	NBD_OPT_INFO             = 6
+	NBD_OPT_GO               = 7
+	NBD_OPT_STRUCTURED_REPLY = 8
+
+	// Option reply types
+	NBD_REP_ACK          = 1
+	NBD_REP_SERVER       = 2
+	NBD_REP_INFO         = 3
+	NBD_REP_FLAG_ERROR   = (1 << 31)
+	NBD_REP_ERR_UNSUP    = 1 | NBD_REP_FLAG_ERROR
+	NBD_REP_ERR_INVALID  = 3 | NBD_REP_FLAG_ERROR
+	NBD_REP_ERR_UNKNOWN  = 6 | NBD_REP_FLAG_ERROR
+	NBD_REP_ERR_TLS_REQD = 5 | NBD_REP_FLAG_ERROR
+
+	// NBD_OPT_INFO/NBD_OPT_GO info types
+	NBD_INFO_EXPORT      = 0
+	NBD_INFO_NAME        = 1
+	NBD_INFO_DESCRIPTION = 2
+	NBD_INFO_BLOCK_SIZE  = 3
+
+	// maxOptionPayload bounds how much we'll allocate for a single option's
+	// payload. Real option payloads (export names, STARTTLS, etc.) are at
+	// most a few hundred bytes, so a client declaring anything bigger is
+	// misbehaving or hostile, not making legitimate use of a long export
+	// name; trusting its declared length unbounded would let it force a
+	// multi-GiB allocation per option with nothing else sent.
+	maxOptionPayload = 4096
+)
+
+// Server speaks the standardized NBD network protocol (fixed newstyle
+// handshake) and serves a set of named Device exports to any conforming NBD
+// client (qemu-nbd, nbd-client, the Linux kernel client), independent of the
+// ioctl-driven /dev/nbdX path that NBD uses.
+type Server struct {
+	// TLSConfig, when set, is offered to clients via NBD_OPT_STARTTLS; the
+	// connection is upgraded to TLS in place once a client selects it.
+	TLSConfig *tls.Config
+
+	// MaxInFlight bounds how many requests per connection are dispatched to
+	// worker goroutines concurrently. Zero (the default) means 1, i.e.
+	// strictly serial.
+	MaxInFlight int
+
+	// ErrorHandler, if set, is called with protocol and framing errors
+	// encountered while transmitting requests on a connection (a truncated
+	// read, a client that violates the wire format) and with panics
+	// recovered from a malformed handshake, instead of silently dropping
+	// them or crashing the process. Other handshake failures (a truncated
+	// read, a bad option magic, an oversized option length) close the
+	// connection without calling it.
+	ErrorHandler func(error)
+}
+
+func (s *Server) reportError(err error) {
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(err)
+	}
+}
+
+// ListenAndServe accepts connections on addr and serves exports by name
+// until the listener is closed or Accept fails. Each connection runs in its
+// own goroutine, so multiple clients (or multiple connections from one
+// client) may share the same export concurrently.
+func (s *Server) ListenAndServe(addr string, exports map[string]Device) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn, exports)
+	}
+}
+
+// serve runs the fixed newstyle handshake on conn and, once the client picks
+// an export via NBD_OPT_EXPORT_NAME or NBD_OPT_GO, hands off to transmit for
+// the request/reply loop.
+func (s *Server) serve(conn net.Conn, exports map[string]Device) {
+	defer conn.Close()
+	defer func() {
+		// The handshake parses client-controlled lengths and offsets; a
+		// bug there must not take every other connection down with it, so
+		// recover and report instead of letting the goroutine's panic
+		// propagate and crash the whole process.
+		if r := recover(); r != nil {
+			s.reportError(fmt.Errorf("nbd: recovered from panic in handshake: %v", r))
+		}
+	}()
+
+	if err := binary.Write(conn, binary.BigEndian, uint64(NBD_MAGIC)); err != nil {
+		return
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint64(NBD_IHAVEOPT)); err != nil {
+		return
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)); err != nil {
+		return
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return
+	}
+
+	structured := false
+	var rw io.ReadWriter = conn
+
+	// Once TLSConfig is set, TLS is mandatory for every option that exposes
+	// an export: NBD_OPT_INFO, NBD_OPT_GO and NBD_OPT_LIST are rejected with
+	// NBD_REP_ERR_TLS_REQD, and NBD_OPT_EXPORT_NAME drops the connection,
+	// until the client negotiates it, so neither the export data nor the list
+	// of export names is ever bypassable in plaintext. NBD_OPT_STRUCTURED_REPLY
+	// is still accepted before TLS, and unknown options get NBD_REP_ERR_UNSUP.
+	tlsRequired := s.TLSConfig != nil
+	tlsEstablished := false
+
+	for {
+		var magic uint64
+		var opt, optlen uint32
+		if err := binary.Read(rw, binary.BigEndian, &magic); err != nil {
+			return
+		}
+		if magic != NBD_IHAVEOPT {
+			return
+		}
+		if err := binary.Read(rw, binary.BigEndian, &opt); err != nil {
+			return
+		}
+		if err := binary.Read(rw, binary.BigEndian, &optlen); err != nil {
+			return
+		}
+		if optlen > maxOptionPayload {
+			return
+		}
+		data := make([]byte, optlen)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return
+		}
+
+		switch opt {
+		case NBD_OPT_STARTTLS:
+			if s.TLSConfig == nil {
+				writeOptReply(rw, opt, NBD_REP_ERR_UNSUP, nil)
+				continue
+			}
+			if tlsEstablished {
+				// A second STARTTLS would re-wrap the already-TLS-wrapped
+				// conn instead of rw, desynchronizing the connection;
+				// reject the redundant request instead.
+				writeOptReply(rw, opt, NBD_REP_ERR_INVALID, nil)
+				continue
+			}
+			writeOptReply(rw, opt, NBD_REP_ACK, nil)
+			tlsConn := tls.Server(conn, s.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			rw = tlsConn
+			tlsEstablished = true
+		case NBD_OPT_STRUCTURED_REPLY:
+			structured = true
+			writeOptReply(rw, opt, NBD_REP_ACK, nil)
+		case NBD_OPT_LIST:
+			if tlsRequired && !tlsEstablished {
+				writeOptReply(rw, opt, NBD_REP_ERR_TLS_REQD, nil)
+				continue
+			}
+			for name := range exports {
+				b := make([]byte, 4+len(name))
+				binary.BigEndian.PutUint32(b, uint32(len(name)))
+				copy(b[4:], name)
+				writeOptReplyInfo(rw, opt, NBD_REP_SERVER, 0, b)
+			}
+			writeOptReply(rw, opt, NBD_REP_ACK, nil)
+		case NBD_OPT_ABORT:
+			writeOptReply(rw, opt, NBD_REP_ACK, nil)
+			return
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			if tlsRequired && !tlsEstablished {
+				writeOptReply(rw, opt, NBD_REP_ERR_TLS_REQD, nil)
+				continue
+			}
+			if len(data) < 4 {
+				writeOptReply(rw, opt, NBD_REP_ERR_INVALID, nil)
+				continue
+			}
+			nameLen := binary.BigEndian.Uint32(data[0:4])
+			if nameLen > uint32(len(data)-4) {
+				writeOptReply(rw, opt, NBD_REP_ERR_INVALID, nil)
+				continue
+			}
+			name := string(data[4 : 4+nameLen])
+			device, ok := exports[name]
+			if !ok {
+				writeOptReply(rw, opt, NBD_REP_ERR_UNKNOWN, nil)
+				continue
+			}
+
+			export := make([]byte, 10)
+			binary.BigEndian.PutUint64(export[0:8], exportSize(device))
+			binary.BigEndian.PutUint16(export[8:10], transmissionFlags(device))
+			writeOptReplyInfo(rw, opt, NBD_REP_INFO, NBD_INFO_EXPORT, export)
+			writeOptReply(rw, opt, NBD_REP_ACK, nil)
+
+			if opt == NBD_OPT_GO {
+				transmit(rw, device, structured, s.maxInFlight(), s.reportError)
+				return
+			}
+		case NBD_OPT_EXPORT_NAME:
+			if tlsRequired && !tlsEstablished {
+				// NBD_OPT_EXPORT_NAME predates reply-capable options, so
+				// there's no NBD_REP_ERR_TLS_REQD to send here either;
+				// dropping the connection is the best a forced-TLS server
+				// can do against a client that skips NBD_OPT_STARTTLS.
+				return
+			}
+			name := string(data)
+			device, ok := exports[name]
+			if !ok {
+				// NBD_OPT_EXPORT_NAME has no error reply in the protocol;
+				// the only graceful option left is to drop the connection.
+				return
+			}
+
+			export := make([]byte, 10)
+			binary.BigEndian.PutUint64(export[0:8], exportSize(device))
+			binary.BigEndian.PutUint16(export[8:10], transmissionFlags(device))
+			rw.Write(export)
+			if clientFlags&NBD_FLAG_C_NO_ZEROES == 0 {
+				rw.Write(make([]byte, 124))
+			}
+
+			transmit(rw, device, structured, s.maxInFlight(), s.reportError)
+			return
+		default:
+			writeOptReply(rw, opt, NBD_REP_ERR_UNSUP, nil)
+		}
+	}
+}
+
+// maxInFlight returns the configured concurrency bound, defaulting to 1
+// (strictly serial) when unset.
+func (s *Server) maxInFlight() int {
+	if s.MaxInFlight < 1 {
+		return 1
+	}
+	return s.MaxInFlight
+}
+
+// exportSize reports the size of an export for the handshake's NBD_INFO_EXPORT
+// reply. Device itself carries no notion of size, so we ask an optional
+// ExportSize() uint64 method (as satisfied by NBD, for instance) and
+// otherwise report zero rather than guessing.
+func exportSize(device Device) uint64 {
+	type sizer interface {
+		ExportSize() uint64
+	}
+	if s, ok := device.(sizer); ok {
+		return s.ExportSize()
+	}
+	return 0
+}
+
+func writeOptReply(rw io.Writer, opt uint32, repType uint32, data []byte) {
+	writeOptReplyInfo(rw, opt, repType, 0, data)
+}
+
+// writeOptReplyInfo writes an option reply; infoType is only meaningful for
+// NBD_REP_INFO replies, where it becomes the leading two bytes of the reply
+// payload. For every other reply type, including NBD_REP_SERVER, it is
+// ignored and data is sent as is.
+func writeOptReplyInfo(rw io.Writer, opt uint32, repType uint32, infoType uint16, data []byte) {
+	binary.Write(rw, binary.BigEndian, uint64(NBD_OPT_REPLY_MAGIC))
+	binary.Write(rw, binary.BigEndian, opt)
+	binary.Write(rw, binary.BigEndian, repType)
+	if repType == NBD_REP_INFO {
+		binary.Write(rw, binary.BigEndian, uint32(len(data)+2))
+		binary.Write(rw, binary.BigEndian, infoType)
+		rw.Write(data)
+	} else {
+		binary.Write(rw, binary.BigEndian, uint32(len(data)))
+		rw.Write(data)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright (C) 2014 Andreas Klauer <Andreas.Klauer@metamorpher.de>
+// License: MIT
+
+package nbd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Structured replies, advertised via NBD_OPT_STRUCTURED_REPLY.
+	NBD_STRUCTURED_REPLY_MAGIC = 0x668e33ef
+	NBD_REPLY_FLAG_DONE        = (1 << 0)
+
+	NBD_REPLY_TYPE_NONE         = 0
+	NBD_REPLY_TYPE_OFFSET_DATA  = 1
+	NBD_REPLY_TYPE_OFFSET_HOLE  = 2
+	NBD_REPLY_TYPE_ERROR        = (1 << 15) | 1
+	NBD_REPLY_TYPE_ERROR_OFFSET = (1 << 15) | 2
+)
+
+// transmissionFlags computes the per-export transmission flags advertised
+// during the handshake and, for the ioctl path, via NBD_SET_FLAGS:
+// NBD_FLAG_HAS_FLAGS, flush and FUA support are always on, trim and
+// write-zeroes only when the backing Device implements the corresponding
+// optional interface.
+func transmissionFlags(device Device) uint16 {
+	flags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA)
+	if _, ok := device.(Trimmer); ok {
+		flags |= NBD_FLAG_SEND_TRIM
+	}
+	if _, ok := device.(Zeroer); ok {
+		flags |= NBD_FLAG_SEND_WRITE_ZEROES
+	}
+	return flags
+}
+
+// zeroFill emulates NBD_CMD_WRITE_ZEROES for devices that don't implement
+// Zeroer, so clients always get correct zero-on-read semantics regardless of
+// what the backing Device supports.
+func zeroFill(device Device, from int64, length uint32) error {
+	_, err := device.WriteAt(make([]byte, length), from)
+	return err
+}
+
+// defaultBufSize covers the overwhelming majority of requests in one shot;
+// anything larger falls back to a one-off allocation.
+const defaultBufSize = 2 << 19
+
+// bufPool hands out scratch buffers so that read/write workers don't each
+// allocate their own megabyte-sized buffer per request.
+var bufPool = sync.Pool{
+	New: func() interface{} { return make([]byte, defaultBufSize) },
+}
+
+// getBuf returns a pool buffer of at least n bytes, growing past the pool's
+// default size only for unusually large requests.
+func getBuf(n uint32) []byte {
+	buf := bufPool.Get().([]byte)
+	if cap(buf) < int(n) {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// putBuf returns buf to the pool, unless it was a one-off oversized
+// allocation that isn't worth keeping around.
+func putBuf(buf []byte) {
+	if cap(buf) == defaultBufSize {
+		bufPool.Put(buf[:defaultBufSize])
+	}
+}
+
+// syncWriter serializes writes from concurrent workers onto a single
+// connection: replies may legitimately complete out of order, but the bytes
+// of any one reply must never interleave with another's.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// transmit runs the request/reply loop for a single export connection. It is
+// shared by the ioctl-driven NBD type, where rw wraps the kernel-negotiated
+// socket, and by Server's TCP connections once the handshake has picked an
+// export. When structured is true, replies use the structured-reply framing
+// negotiated via NBD_OPT_STRUCTURED_REPLY; otherwise they use the original
+// simple-reply framing, so /dev/nbdX connections keep working unchanged.
+//
+// A single reader goroutine (this one) parses requests and dispatches each
+// to a worker goroutine, bounded to maxInFlight at a time, so one slow
+// device operation no longer stalls every other request on the connection.
+// Replies are serialized onto w through a mutex rather than through a
+// dedicated writer goroutine, since workers may finish in any order.
+//
+// onError, if non-nil, is called with protocol and framing errors (a
+// truncated read, a client that violates the wire format) instead of
+// panicking; it is never called for ordinary Device errors, which are
+// reported to the client as an errno in the reply instead. onError may be
+// nil, in which case such errors are simply dropped.
+func transmit(rw io.ReadWriter, device Device, structured bool, maxInFlight int, onError func(error)) {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	if onError == nil {
+		onError = func(error) {}
+	}
+
+	w := &syncWriter{w: rw}
+	sem := make(chan struct{}, maxInFlight)
+	var workers sync.WaitGroup
+	var writesInFlight sync.WaitGroup
+	defer workers.Wait()
+
+	hdr := make([]byte, 28)
+
+	for {
+		if _, err := io.ReadFull(rw, hdr); err != nil {
+			if err != io.EOF {
+				onError(err)
+			}
+			return
+		}
+
+		var x request
+		x.magic = binary.BigEndian.Uint32(hdr)
+		x.flags = binary.BigEndian.Uint16(hdr[4:6])
+		x.typus = binary.BigEndian.Uint16(hdr[6:8])
+		x.handle = binary.BigEndian.Uint64(hdr[8:16])
+		x.from = binary.BigEndian.Uint64(hdr[16:24])
+		x.len = binary.BigEndian.Uint32(hdr[24:28])
+
+		if x.magic != NBD_REQUEST_MAGIC {
+			onError(errors.New("nbd: invalid request magic, dropping connection"))
+			return
+		}
+
+		if x.typus == NBD_CMD_DISC {
+			workers.Wait()
+			return
+		}
+
+		var buf []byte
+		switch x.typus {
+		case NBD_CMD_READ:
+			buf = getBuf(x.len)
+		case NBD_CMD_WRITE:
+			buf = getBuf(x.len)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				onError(err)
+				return
+			}
+		}
+
+		if x.typus == NBD_CMD_FLUSH {
+			// FLUSH must only observe writes dispatched before it. The
+			// reader is single-threaded, so blocking here guarantees every
+			// write already handed to a worker finishes first, and that no
+			// write belonging to "after the flush" has been counted yet.
+			writesInFlight.Wait()
+		}
+
+		sem <- struct{}{}
+		workers.Add(1)
+		if x.typus == NBD_CMD_WRITE {
+			writesInFlight.Add(1)
+		}
+
+		go func(x request, buf []byte) {
+			defer func() { <-sem }()
+			defer workers.Done()
+			if x.typus == NBD_CMD_WRITE {
+				defer writesInFlight.Done()
+			}
+
+			if err := dispatch(device, w, structured, x, buf); err != nil {
+				onError(err)
+			}
+
+			if buf != nil {
+				putBuf(buf)
+			}
+		}(x, buf)
+	}
+}
+
+// dispatch performs the device operation for a single request and writes
+// its reply, returning any error encountered while writing that reply (a
+// framing concern the caller should log); Device errors are translated into
+// the reply's errno field rather than returned here. It runs on a worker
+// goroutine, so it must not touch anything that isn't safe for concurrent
+// use: device, w and the request itself.
+func dispatch(device Device, w io.Writer, structured bool, x request, buf []byte) error {
+	switch x.typus {
+	case NBD_CMD_READ:
+		_, err := device.ReadAt(buf, int64(x.from))
+		if err != nil {
+			return writeAck(w, structured, x.handle, nbdErrno(err))
+		}
+		if structured {
+			return writeStructuredData(w, x.handle, x.from, buf)
+		}
+		return writeSimpleReply(w, x.handle, 0, buf)
+	case NBD_CMD_WRITE:
+		_, err := device.WriteAt(buf, int64(x.from))
+		if err == nil && x.flags&NBD_CMD_FLAG_FUA != 0 {
+			err = device.Sync()
+		}
+		return writeAck(w, structured, x.handle, nbdErrno(err))
+	case NBD_CMD_FLUSH:
+		return writeAck(w, structured, x.handle, nbdErrno(device.Sync()))
+	case NBD_CMD_TRIM:
+		if t, ok := device.(Trimmer); ok {
+			return writeAck(w, structured, x.handle, nbdErrno(t.TrimAt(int64(x.from), x.len)))
+		}
+		return writeAck(w, structured, x.handle, NBD_EINVAL)
+	case NBD_CMD_WRITE_ZEROES:
+		var err error
+		if z, ok := device.(Zeroer); ok {
+			err = z.ZeroAt(int64(x.from), x.len, uint32(x.flags))
+		} else {
+			err = zeroFill(device, int64(x.from), x.len)
+		}
+		return writeAck(w, structured, x.handle, nbdErrno(err))
+	default:
+		return writeAck(w, structured, x.handle, NBD_EINVAL)
+	}
+}
+
+// nbdErrno maps a Device error onto the errno NBD sends back to the client:
+// the real value when the error wraps a syscall.Errno (as os.PathError
+// does, e.g. for a Device backed by an *os.File), EIO otherwise.
+func nbdErrno(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return uint32(errno)
+	}
+	return NBD_EIO
+}
+
+// writeAck emits a data-less reply (write/flush/trim acknowledgements and
+// their errors) in whichever framing was negotiated for the connection.
+func writeAck(rw io.Writer, structured bool, handle uint64, errno uint32) error {
+	if !structured {
+		return writeSimpleReply(rw, handle, errno, nil)
+	}
+	if errno != 0 {
+		return writeStructuredError(rw, handle, errno)
+	}
+	return writeStructuredNone(rw, handle, 0)
+}
+
+func writeSimpleReply(rw io.Writer, handle uint64, errno uint32, data []byte) error {
+	head := make([]byte, 16)
+	binary.BigEndian.PutUint32(head[0:4], NBD_REPLY_MAGIC)
+	binary.BigEndian.PutUint32(head[4:8], errno)
+	binary.BigEndian.PutUint64(head[8:16], handle)
+	if _, err := rw.Write(head); err != nil {
+		return err
+	}
+	if data != nil {
+		_, err := rw.Write(data)
+		return err
+	}
+	return nil
+}
+
+// writeStructuredData sends a read reply as a single NBD_REPLY_TYPE_OFFSET_DATA
+// chunk with the done flag set; reads are never split into multiple chunks.
+func writeStructuredData(rw io.Writer, handle uint64, from uint64, data []byte) error {
+	head := make([]byte, 20)
+	binary.BigEndian.PutUint32(head[0:4], NBD_STRUCTURED_REPLY_MAGIC)
+	binary.BigEndian.PutUint16(head[4:6], NBD_REPLY_FLAG_DONE)
+	binary.BigEndian.PutUint16(head[6:8], NBD_REPLY_TYPE_OFFSET_DATA)
+	binary.BigEndian.PutUint64(head[8:16], handle)
+	binary.BigEndian.PutUint32(head[16:20], uint32(8+len(data)))
+	if _, err := rw.Write(head); err != nil {
+		return err
+	}
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], from)
+	if _, err := rw.Write(offset[:]); err != nil {
+		return err
+	}
+	_, err := rw.Write(data)
+	return err
+}
+
+func writeStructuredNone(rw io.Writer, handle uint64, errno uint32) error {
+	head := make([]byte, 20)
+	binary.BigEndian.PutUint32(head[0:4], NBD_STRUCTURED_REPLY_MAGIC)
+	binary.BigEndian.PutUint16(head[4:6], NBD_REPLY_FLAG_DONE)
+	binary.BigEndian.PutUint16(head[6:8], NBD_REPLY_TYPE_NONE)
+	binary.BigEndian.PutUint64(head[8:16], handle)
+	binary.BigEndian.PutUint32(head[16:20], 0)
+	_, err := rw.Write(head)
+	return err
+}
+
+func writeStructuredError(rw io.Writer, handle uint64, errno uint32) error {
+	head := make([]byte, 20)
+	binary.BigEndian.PutUint32(head[0:4], NBD_STRUCTURED_REPLY_MAGIC)
+	binary.BigEndian.PutUint16(head[4:6], NBD_REPLY_FLAG_DONE)
+	binary.BigEndian.PutUint16(head[6:8], NBD_REPLY_TYPE_ERROR)
+	binary.BigEndian.PutUint64(head[8:16], handle)
+	binary.BigEndian.PutUint32(head[16:20], 6)
+	if _, err := rw.Write(head); err != nil {
+		return err
+	}
+	var errAndLen [6]byte
+	binary.BigEndian.PutUint32(errAndLen[0:4], errno)
+	binary.BigEndian.PutUint16(errAndLen[4:6], 0)
+	_, err := rw.Write(errAndLen[:])
+	return err
+}